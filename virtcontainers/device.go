@@ -0,0 +1,184 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package virtcontainers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultDevicePermissions is used when devicesFromPath is not given an
+// explicit permissions string.
+const defaultDevicePermissions = "rwm"
+
+// Device describes a single host character or block device to be made
+// available inside the container, by the major:minor pair the guest needs
+// to create (or bind mount) the matching node at Destination.
+type Device struct {
+	Source      string
+	Destination string
+	Permissions string
+	// Type is 'c' for a character device or 'b' for a block device,
+	// following the convention used elsewhere for cgroup device rules.
+	Type     rune
+	FileMode os.FileMode
+	UID      uint32
+	GID      uint32
+	Major    int64
+	Minor    int64
+}
+
+// devicesFromPath accepts a host[:container[:perms]]-style device spec
+// already split into its hostPath, containerPath and perms parts (perms
+// defaults to "rwm" when empty) and resolves it into zero or more Devices.
+//
+// hostPath may be a glob (e.g. "/dev/nvidia*"); each match is resolved
+// independently. A match that resolves (after following symlinks once) to a
+// directory is walked and one Device is emitted per character or block node
+// found underneath it, mirroring the directory's relative structure under
+// containerPath; a match that is itself a device node yields a single
+// Device; anything else (regular files, sockets, ...) is silently skipped,
+// since it cannot be represented as a passthrough device node.
+func devicesFromPath(hostPath, containerPath, perms string) ([]Device, error) {
+	if hostPath == "" {
+		return nil, fmt.Errorf("host path cannot be empty")
+	}
+
+	if perms == "" {
+		perms = defaultDevicePermissions
+	}
+
+	if containerPath == "" {
+		containerPath = hostPath
+	}
+
+	matches, err := filepath.Glob(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device glob %q: %w", hostPath, err)
+	}
+
+	if len(matches) == 0 {
+		matches = []string{hostPath}
+	}
+
+	hostBase := globBase(hostPath)
+	containerBase := globBase(containerPath)
+
+	var devices []Device
+	for _, match := range matches {
+		matchContainerPath := containerPath
+		if match != hostPath {
+			matchContainerPath = filepath.Join(containerBase, strings.TrimPrefix(match, hostBase))
+		}
+
+		found, err := devicesFromMatch(match, matchContainerPath, perms)
+		if err != nil {
+			return nil, err
+		}
+
+		devices = append(devices, found...)
+	}
+
+	return devices, nil
+}
+
+// globBase returns the longest path prefix of pattern that contains no glob
+// meta-characters, i.e. the directory filepath.Glob will actually list.
+func globBase(pattern string) string {
+	if idx := strings.IndexAny(pattern, "*?["); idx >= 0 {
+		return filepath.Dir(pattern[:idx])
+	}
+
+	return filepath.Dir(pattern)
+}
+
+// devicesFromMatch resolves a single (already glob-expanded) host path,
+// following symlinks once, and returns the device node(s) found at it.
+func devicesFromMatch(hostPath, containerPath, perms string) ([]Device, error) {
+	resolved, err := filepath.EvalSymlinks(hostPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", hostPath, err)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat %s: %w", resolved, err)
+	}
+
+	if !info.IsDir() {
+		dev, ok, err := deviceFromNode(resolved, containerPath, perms)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return []Device{dev}, nil
+	}
+
+	var devices []Device
+	err = filepath.Walk(resolved, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(resolved, path)
+		if err != nil {
+			return err
+		}
+
+		dev, ok, err := deviceFromNode(path, filepath.Join(containerPath, rel), perms)
+		if err != nil {
+			return err
+		}
+		if ok {
+			devices = append(devices, dev)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// deviceFromNode builds a Device from the character or block node at path.
+// It returns ok == false (and a nil error) for anything else - regular
+// files, sockets, FIFOs - since those cannot be represented as passthrough
+// device nodes.
+func deviceFromNode(path, containerPath, perms string) (dev Device, ok bool, err error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return Device{}, false, fmt.Errorf("could not stat %s: %w", path, err)
+	}
+
+	var nodeType rune
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		nodeType = 'b'
+	case syscall.S_IFCHR:
+		nodeType = 'c'
+	default:
+		return Device{}, false, nil
+	}
+
+	return Device{
+		Source:      path,
+		Destination: containerPath,
+		Permissions: perms,
+		Type:        nodeType,
+		FileMode:    os.FileMode(stat.Mode & 0777),
+		UID:         stat.Uid,
+		GID:         stat.Gid,
+		Major:       int64(major(stat.Rdev)),
+		Minor:       int64(minor(stat.Rdev)),
+	}, true, nil
+}
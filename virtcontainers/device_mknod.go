@@ -0,0 +1,147 @@
+// Copyright (c) 2020 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package virtcontainers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/kata-containers/runtime/virtcontainers/pkg/safepath"
+)
+
+// errRequiresRoot is returned by materializeDeviceNodes when creating a
+// device node failed because the caller lacks CAP_MKNOD, so callers can
+// detect it with errors.As and fall back to bind-mounting the host device
+// instead of giving up outright.
+type errRequiresRoot struct {
+	device string
+}
+
+func (e *errRequiresRoot) Error() string {
+	return fmt.Sprintf("creating device node %s requires root (CAP_MKNOD)", e.device)
+}
+
+// materializeDeviceNodes creates the character/block special files
+// described by devs inside rootfs via mknod(2), so a container can see a
+// curated device list without the host's /dev being bind-mounted wholesale.
+//
+// Each Device.Destination is resolved relative to rootfs through the
+// safepath package (parent directories are created with
+// safepath.MkdirAllNoFollow), so a crafted Destination cannot traverse out
+// of rootfs via "..", a symlink, or a swapped path component.
+//
+// materializeDeviceNodes is idempotent: a destination that already holds a
+// device node of the same type and major:minor is not recreated (only its
+// ownership is set again); one that exists but doesn't match is removed and
+// recreated.
+func materializeDeviceNodes(rootfs string, devs []Device) error {
+	root, err := safepath.OpenNoFollow(rootfs)
+	if err != nil {
+		return fmt.Errorf("could not open rootfs %s: %w", rootfs, err)
+	}
+	defer root.Close()
+
+	for _, dev := range devs {
+		if err := materializeDeviceNode(root, dev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func materializeDeviceNode(root *safepath.Path, dev Device) error {
+	rel := strings.TrimPrefix(filepath.Clean(dev.Destination), "/")
+	parentRel := filepath.Dir(rel)
+	name := filepath.Base(rel)
+
+	parent := root
+	if parentRel != "." {
+		p, err := safepath.MkdirAllNoFollow(root, parentRel, mountPerm)
+		if err != nil {
+			return fmt.Errorf("could not create parent directories for %s: %w", dev.Destination, err)
+		}
+		defer p.Close()
+		parent = p
+	}
+
+	ifmt, wantRdev, err := deviceNodeArgs(dev)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := safepath.JoinNoFollow(parent, name); err == nil {
+		matches := nodeMatches(existing, ifmt, wantRdev)
+		existing.Close()
+
+		if matches {
+			return chownNodeAt(parent, name, dev)
+		}
+
+		if err := unix.Unlinkat(parent.Fd(), name, 0); err != nil {
+			return fmt.Errorf("could not remove stale device node %s: %w", dev.Destination, err)
+		}
+	}
+
+	mode := uint32(ifmt) | uint32(dev.FileMode&0777)
+	if err := unix.Mknodat(parent.Fd(), name, mode, int(wantRdev)); err != nil {
+		if err == unix.EPERM {
+			return &errRequiresRoot{device: dev.Destination}
+		}
+		return fmt.Errorf("could not create device node %s: %w", dev.Destination, err)
+	}
+
+	return chownNodeAt(parent, name, dev)
+}
+
+// deviceNodeArgs returns the syscall.S_IFCHR/S_IFBLK mode bit and the
+// unix.Mkdev-encoded rdev value mknod(2) needs for dev.
+func deviceNodeArgs(dev Device) (ifmt uint32, rdev uint64, err error) {
+	switch dev.Type {
+	case 'c':
+		ifmt = syscall.S_IFCHR
+	case 'b':
+		ifmt = syscall.S_IFBLK
+	default:
+		return 0, 0, fmt.Errorf("device %s has unknown type %q", dev.Destination, dev.Type)
+	}
+
+	return ifmt, unix.Mkdev(uint32(dev.Major), uint32(dev.Minor)), nil
+}
+
+// nodeMatches reports whether the already-resolved node at p is a device
+// node of the same type and major:minor that materializeDeviceNode would
+// otherwise create.
+func nodeMatches(p *safepath.Path, wantIfmt uint32, wantRdev uint64) bool {
+	info, err := safepath.StatNoFollow(p)
+	if err != nil {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	return stat.Mode&syscall.S_IFMT == wantIfmt && stat.Rdev == wantRdev
+}
+
+// chownNodeAt chowns name (the device node just created or matched) via
+// fchownat against parent's fd, with AT_SYMLINK_NOFOLLOW, rather than
+// re-resolving parent.Path()+name as a string - the same "resolve once,
+// operate on the fd" discipline safepath uses elsewhere, so nothing between
+// the earlier check and this chown can redirect it out of rootfs.
+func chownNodeAt(parent *safepath.Path, name string, dev Device) error {
+	if err := unix.Fchownat(parent.Fd(), name, int(dev.UID), int(dev.GID), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("could not chown device node %s: %w", dev.Destination, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package virtcontainers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/kata-containers/runtime/virtcontainers/pkg/safepath"
+)
+
+func nullDevice(destination string) Device {
+	return Device{
+		Source:      "/dev/null",
+		Destination: destination,
+		Permissions: "rwm",
+		Type:        'c',
+		FileMode:    0666,
+		Major:       1,
+		Minor:       3,
+	}
+}
+
+func TestMaterializeDeviceNodesRefusesTraversal(t *testing.T) {
+	rootfs := t.TempDir()
+
+	err := materializeDeviceNodes(rootfs, []Device{nullDevice("../../etc/evil")})
+	assert.Error(t, err)
+
+	_, statErr := os.Lstat(filepath.Join(filepath.Dir(filepath.Dir(rootfs)), "etc", "evil"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestMaterializeDeviceNodesNonRootReturnsTypedError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Test disabled as it requires a non-root user")
+	}
+
+	rootfs := t.TempDir()
+
+	err := materializeDeviceNodes(rootfs, []Device{nullDevice("/dev/null")})
+	assert.Error(t, err)
+
+	var rootErr *errRequiresRoot
+	assert.True(t, errors.As(err, &rootErr))
+}
+
+func TestMaterializeDeviceNodesIdempotent(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	rootfs := t.TempDir()
+	dev := nullDevice("/dev/null")
+
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{dev}))
+
+	path := filepath.Join(rootfs, "dev", "null")
+	before := syscall.Stat_t{}
+	assert.NoError(t, syscall.Stat(path, &before))
+
+	// Re-materializing an already-matching node must be a no-op, not an
+	// error, and must not recreate the node.
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{dev}))
+
+	after := syscall.Stat_t{}
+	assert.NoError(t, syscall.Stat(path, &after))
+	assert.Equal(t, before.Ino, after.Ino)
+}
+
+func TestMaterializeDeviceNodesNestedDirs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	rootfs := t.TempDir()
+
+	// /dev already exists by the time we walk past it to create dri/,
+	// regressing a bug where MkdirAllNoFollow broke on any Destination
+	// nested two or more directories deep under a pre-existing prefix.
+	assert.NoError(t, os.MkdirAll(filepath.Join(rootfs, "dev"), mountPerm))
+
+	dev := nullDevice("/dev/dri/card0")
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{dev}))
+
+	path := filepath.Join(rootfs, "dev", "dri", "card0")
+	stat := syscall.Stat_t{}
+	assert.NoError(t, syscall.Stat(path, &stat))
+
+	// Re-materializing must still be idempotent past the nested walk.
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{dev}))
+}
+
+func TestChownNodeAtDoesNotFollowSwappedSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	victim := filepath.Join(t.TempDir(), "victim")
+	assert.NoError(t, os.WriteFile(victim, []byte("x"), 0644))
+
+	var victimBefore unix.Stat_t
+	assert.NoError(t, unix.Stat(victim, &victimBefore))
+
+	destDir := t.TempDir()
+
+	// Simulate an attacker swapping the device node for a symlink to an
+	// arbitrary host file in between materializeDeviceNode's match check
+	// and the chown that follows it.
+	link := filepath.Join(destDir, "null")
+	assert.NoError(t, os.Symlink(victim, link))
+
+	parent, err := safepath.OpenNoFollow(destDir)
+	assert.NoError(t, err)
+	defer parent.Close()
+
+	dev := nullDevice("/dev/null")
+	dev.UID = 1234
+	dev.GID = 1234
+	assert.NoError(t, chownNodeAt(parent, "null", dev))
+
+	// chownNodeAt must have chowned the symlink itself (AT_SYMLINK_NOFOLLOW),
+	// not the file it points at.
+	var linkStat unix.Stat_t
+	assert.NoError(t, unix.Lstat(link, &linkStat))
+	assert.EqualValues(t, 1234, linkStat.Uid)
+
+	var victimAfter unix.Stat_t
+	assert.NoError(t, unix.Stat(victim, &victimAfter))
+	assert.Equal(t, victimBefore.Uid, victimAfter.Uid)
+}
+
+func TestMaterializeDeviceNodesRecreatesMismatch(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	rootfs := t.TempDir()
+	wrong := nullDevice("/dev/null")
+	wrong.Minor = 5 // /dev/zero's minor, not /dev/null's
+
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{wrong}))
+
+	right := nullDevice("/dev/null")
+	assert.NoError(t, materializeDeviceNodes(rootfs, []Device{right}))
+
+	path := filepath.Join(rootfs, "dev", "null")
+	stat := syscall.Stat_t{}
+	assert.NoError(t, syscall.Stat(path, &stat))
+	assert.Equal(t, int64(minor(stat.Rdev)), right.Minor)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package virtcontainers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevicesFromPathSingleNode(t *testing.T) {
+	devices, err := devicesFromPath("/dev/null", "/dev/null", "")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "/dev/null", devices[0].Source)
+	assert.Equal(t, "/dev/null", devices[0].Destination)
+	assert.Equal(t, defaultDevicePermissions, devices[0].Permissions)
+}
+
+func TestDevicesFromPathDirectoryMixedNodes(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.Link("/dev/null", filepath.Join(dir, "nullish")); err != nil {
+		t.Skipf("cannot hard link /dev/null in this environment: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "notadevice"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := devicesFromPath(dir, "/dev/mixed", "rw")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, filepath.Join("/dev/mixed", "nullish"), devices[0].Destination)
+	assert.Equal(t, "rw", devices[0].Permissions)
+}
+
+func TestDevicesFromPathGlob(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"nvidia0", "nvidia1"} {
+		if err := os.Link("/dev/null", filepath.Join(dir, name)); err != nil {
+			t.Skipf("cannot hard link /dev/null in this environment: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nvidiactl-notes"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := devicesFromPath(filepath.Join(dir, "nvidia*"), filepath.Join(dir, "nvidia*"), "")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+}
+
+func TestDevicesFromPathSymlinkToDirectory(t *testing.T) {
+	real := filepath.Join(t.TempDir(), "real")
+	if err := os.MkdirAll(real, mountPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Link("/dev/null", filepath.Join(real, "nullish")); err != nil {
+		t.Skipf("cannot hard link /dev/null in this environment: %v", err)
+	}
+
+	link := filepath.Join(filepath.Dir(real), "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := devicesFromPath(link, "/dev/via-symlink", "")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, filepath.Join("/dev/via-symlink", "nullish"), devices[0].Destination)
+}
+
+func TestDevicesFromPathRegularFileIsFiltered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foobar")
+	if err := os.WriteFile(path, []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := devicesFromPath(path, "/dev/foobar", "")
+	assert.NoError(t, err)
+	assert.Empty(t, devices)
+}
@@ -0,0 +1,395 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package virtcontainers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kata-containers/runtime/virtcontainers/pkg/safepath"
+)
+
+const (
+	mountPerm os.FileMode = 0755
+
+	// maxSCSIDevices is the highest 0-based SCSI device index that can be
+	// addressed on a single SCSI controller using the LUN scheme below.
+	maxSCSIDevices = 65535
+
+	// scsiDevicesPerController is the number of LUNs exposed per virtual
+	// SCSI target/channel before the id rolls over onto the next one.
+	scsiDevicesPerController = 256
+)
+
+// watchBlockDeviceTimeout and watchBlockDevicePollInterval bound how long,
+// and how often, GetDevicePath polls for a sysfs path (such as a partition
+// subdirectory) to show up after a device has been hot-plugged. They are
+// variables rather than constants so unit tests can shorten them.
+var (
+	watchBlockDeviceTimeout      = 5 * time.Second
+	watchBlockDevicePollInterval = 50 * time.Millisecond
+)
+
+// blockFormatTemplate is the path template used to look up a block device's
+// sysfs entry from its major:minor pair. It is a variable (rather than a
+// constant) so that unit tests can point it at a fake sysfs tree.
+var blockFormatTemplate = "/sys/dev/block/%d:%d"
+
+// device represents the block device backing a given mount point.
+type device struct {
+	mountPoint string
+	major      int
+	minor      int
+}
+
+func major(dev uint64) int {
+	return int((dev >> 8) & 0xfff)
+}
+
+func minor(dev uint64) int {
+	return int((dev & 0xff) | ((dev >> 12) & 0xfff00))
+}
+
+// isSystemMount returns true if the given mount point is a system one,
+// i.e. it's either /sys or a subdirectory of it.
+func isSystemMount(m string) bool {
+	if m == "/sys" {
+		return true
+	}
+
+	if strings.HasPrefix(m, "/sys/") {
+		return true
+	}
+
+	return false
+}
+
+// isHostDevice returns true if the given mount point is part of the host's
+// /dev namespace: /dev itself, an actual character or block device node
+// under it, or one of its device-category subdirectories (e.g. /dev/block).
+// A plain regular file placed under /dev is not a host device.
+func isHostDevice(mountPath string) bool {
+	if mountPath == "/dev" {
+		return true
+	}
+
+	if !strings.HasPrefix(mountPath, "/dev/") {
+		return false
+	}
+
+	stat, err := os.Stat(mountPath)
+	if err != nil {
+		// Nothing to inspect yet (the node doesn't exist on the host),
+		// but it's still destined to live under /dev.
+		return true
+	}
+
+	return stat.Mode()&os.ModeDevice != 0 || stat.IsDir()
+}
+
+// getDeviceForPath returns the device backing the given path. The path is
+// resolved with safepath.JoinNoFollow (refusing to follow any symlink along
+// the way, including the final component) and the mount point is then read
+// off the resulting fd via safepath.DeviceForFD, so a symlink swapped in
+// after resolution cannot redirect which device is reported.
+func getDeviceForPath(path string) (device, error) {
+	if path == "" {
+		return device{}, fmt.Errorf("path cannot be empty")
+	}
+
+	resolved, err := resolveNoFollow(path)
+	if err != nil {
+		return device{}, err
+	}
+	defer resolved.Close()
+
+	mountPoint, err := safepath.DeviceForFD(resolved)
+	if err != nil {
+		return device{}, err
+	}
+
+	stat, err := safepath.StatNoFollow(resolved)
+	if err != nil {
+		return device{}, err
+	}
+
+	sysStat, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return device{}, fmt.Errorf("unexpected stat type for %s", path)
+	}
+
+	return device{
+		mountPoint: mountPoint,
+		major:      major(sysStat.Dev),
+		minor:      minor(sysStat.Dev),
+	}, nil
+}
+
+// resolveNoFollow opens the absolute parent directory of path and walks the
+// remainder with safepath.JoinNoFollow, so that every component of path
+// (including the final one) is opened with O_NOFOLLOW rather than resolved
+// as a string.
+func resolveNoFollow(path string) (*safepath.Path, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := safepath.OpenNoFollow("/")
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	rel := strings.TrimPrefix(filepath.Clean(absolute), "/")
+	if rel == "" {
+		rel = "."
+	}
+
+	return safepath.JoinNoFollow(root, rel)
+}
+
+// bindMount bind mounts source onto destination, optionally read-only.
+// Both paths are resolved with safepath.JoinNoFollow before the mount(2)
+// call, so the "resolve, check, use" sequence is atomic with respect to the
+// resolved fd rather than racy on the path strings.
+func bindMount(source, destination string, readonly bool) error {
+	if source == "" {
+		return fmt.Errorf("source must be specified")
+	}
+	if destination == "" {
+		return fmt.Errorf("destination must be specified")
+	}
+
+	sourcePath, err := resolveNoFollow(source)
+	if err != nil {
+		return fmt.Errorf("could not resolve bind mount source %s: %w", source, err)
+	}
+	defer sourcePath.Close()
+
+	destPath, err := resolveNoFollow(destination)
+	if err != nil {
+		return fmt.Errorf("could not resolve bind mount destination %s: %w", destination, err)
+	}
+	defer destPath.Close()
+
+	if err := safepath.BindMountAt(sourcePath, destPath, readonly); err != nil {
+		return fmt.Errorf("could not bind mount %s to %s: %w", source, destination, err)
+	}
+
+	return nil
+}
+
+// getDevicePathAndFsType returns the device path and filesystem type backing
+// the given mount point, as reported by /proc/mounts.
+func getDevicePathAndFsType(mountPoint string) (devicePath, fsType string, err error) {
+	if mountPoint == "" {
+		return "", "", fmt.Errorf("mount point cannot be empty")
+	}
+
+	content, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		if fields[1] == mountPoint {
+			return fields[0], fields[2], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("could not find device for mount point %s", mountPoint)
+}
+
+// isDeviceMapper returns true if the block device identified by major:minor
+// is backed by the device-mapper driver.
+func isDeviceMapper(major, minor int) (bool, error) {
+	path := fmt.Sprintf(blockFormatTemplate, major, minor)
+
+	_, err := os.Stat(filepath.Join(path, "dm"))
+	if err == nil {
+		return true, nil
+	}
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// getVirtDriveName returns the virtio-blk drive name (vda, vdb, ..., vdaa,
+// ...) corresponding to the given 0-based index, following the same
+// spreadsheet-column naming scheme the kernel uses.
+func getVirtDriveName(index int) (string, error) {
+	if index < 0 {
+		return "", fmt.Errorf("index cannot be negative")
+	}
+
+	// Drive name allows 26 letters (a-z)
+	base := 26
+
+	suffix := ""
+	for index >= 0 {
+		letter := byte('a' + (index % base))
+		suffix = string(letter) + suffix
+		index = (index / base) - 1
+	}
+
+	return "vd" + suffix, nil
+}
+
+// getSCSIIdLun returns the SCSI id and lun for a given 0-based index,
+// accepting indexes 0 through maxSCSIDevices across multiple SCSI ids.
+func getSCSIIdLun(index int) (scsiID, lun int, err error) {
+	if index < 0 || index > maxSCSIDevices {
+		return -1, -1, fmt.Errorf("invalid SCSI index %d", index)
+	}
+
+	return index / scsiDevicesPerController, index % scsiDevicesPerController, nil
+}
+
+// getSCSIAddress returns the "scsiID:lun" address string for a given
+// 0-based index.
+func getSCSIAddress(index int) (string, error) {
+	scsiID, lun, err := getSCSIIdLun(index)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(scsiID) + ":" + strconv.Itoa(lun), nil
+}
+
+// scsiBlockSysfsTemplate is the path template used to locate a SCSI disk's
+// block sysfs directory from its host:id:lun address. It is a variable
+// (rather than a constant) so that unit tests can point it at a fake sysfs
+// tree, following the same pattern as blockFormatTemplate.
+var scsiBlockSysfsTemplate = "/sys/bus/scsi/devices/%d:0:%d:%d/block"
+
+// scsiBlockSysfsPath returns the sysfs path of the (whole-disk) block device
+// attached at the given SCSI host:id:lun address, e.g.
+// /sys/bus/scsi/devices/<host>:0:<id>:<lun>/block.
+func scsiBlockSysfsPath(host, scsiID, lun int) string {
+	return fmt.Sprintf(scsiBlockSysfsTemplate, host, scsiID, lun)
+}
+
+// globSingleBlockDevice globs pattern and returns the single base name it
+// resolves to, erroring out if it resolves to zero or more than one entry.
+func globSingleBlockDevice(pattern string) (string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) != 1 {
+		return "", fmt.Errorf("expecting exactly one block device matching %s, found %d", pattern, len(matches))
+	}
+
+	return filepath.Base(matches[0]), nil
+}
+
+// waitForPath polls for path to exist, up to watchBlockDeviceTimeout,
+// returning an error if the deadline is reached first.
+func waitForPath(ctx context.Context, path string) error {
+	deadline := time.Now().Add(watchBlockDeviceTimeout)
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s to appear", watchBlockDeviceTimeout, path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchBlockDevicePollInterval):
+		}
+	}
+}
+
+// virtioControllerIndex is the sentinel value passed as the controller
+// argument to GetDevicePath to request resolution of a virtio-blk drive
+// (identified purely by its lun/index) rather than a SCSI one.
+const virtioControllerIndex = -1
+
+// GetDevicePath resolves the /dev path of a disk attached to the guest,
+// optionally targeting a specific partition of that disk rather than the
+// whole device.
+//
+// When controller is virtioControllerIndex, lun is treated as the virtio-blk
+// index passed to getVirtDriveName. Otherwise, controller is the SCSI host
+// and lun is the 0-based index the disk was hot-plugged at, which
+// getSCSIIdLun splits into a SCSI id and lun; the base device's sysfs path is
+// then resolved under /sys/bus/scsi/devices/<controller>:0:<id>:<lun>/block.
+//
+// When partition is greater than zero, GetDevicePath waits (bounded by
+// watchBlockDeviceTimeout) for the kernel to publish the partition's sysfs
+// subdirectory before returning its device path, since partition scanning
+// can lag behind the disk itself showing up.
+func GetDevicePath(ctx context.Context, controller, lun, partition int) (string, error) {
+	if partition < 0 {
+		return "", fmt.Errorf("partition cannot be negative")
+	}
+
+	if controller == virtioControllerIndex {
+		driveName, err := getVirtDriveName(lun)
+		if err != nil {
+			return "", err
+		}
+
+		return virtioDevicePath(driveName, partition), nil
+	}
+
+	scsiID, scsiLun, err := getSCSIIdLun(lun)
+	if err != nil {
+		return "", err
+	}
+
+	sysfsPath := scsiBlockSysfsPath(controller, scsiID, scsiLun)
+
+	baseName, err := globSingleBlockDevice(filepath.Join(sysfsPath, "sd*"))
+	if err != nil {
+		return "", err
+	}
+
+	if partition == 0 {
+		return filepath.Join("/dev", baseName), nil
+	}
+
+	partitionName := fmt.Sprintf("%s%d", baseName, partition)
+	partitionSysfsPath := filepath.Join(sysfsPath, baseName, partitionName)
+
+	if err := waitForPath(ctx, partitionSysfsPath); err != nil {
+		return "", err
+	}
+
+	return filepath.Join("/dev", partitionName), nil
+}
+
+// virtioDevicePath returns the /dev path for a virtio-blk drive, optionally
+// suffixed with a partition index.
+func virtioDevicePath(driveName string, partition int) string {
+	if partition == 0 {
+		return filepath.Join("/dev", driveName)
+	}
+
+	return filepath.Join("/dev", fmt.Sprintf("%s%d", driveName, partition))
+}
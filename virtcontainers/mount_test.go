@@ -7,6 +7,7 @@ package virtcontainers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -15,6 +16,7 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -238,6 +240,35 @@ func TestGetDeviceForPathBindMount(t *testing.T) {
 	}
 }
 
+func TestGetDeviceForPathRefusesSymlinkRace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	outside := filepath.Join(testDir, "testDeviceForPathOutside")
+	trap := filepath.Join(testDir, "testDeviceForPathTrap")
+	os.RemoveAll(outside)
+	os.RemoveAll(trap)
+
+	if err := os.MkdirAll(outside, mountPerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	// Plant a symlink where a caller might expect a plain directory: a
+	// resolver that re-resolves the path string after an initial check
+	// would happily follow it out of the sandboxed tree.
+	if err := os.Symlink(outside, trap); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(trap)
+
+	victim := filepath.Join(trap, "evil")
+	if _, err := getDeviceForPath(victim); err == nil {
+		t.Fatal("expected getDeviceForPath to refuse to follow symlink component")
+	}
+}
+
 func TestGetDevicePathAndFsTypeEmptyMount(t *testing.T) {
 	_, _, err := getDevicePathAndFsType("")
 
@@ -364,3 +395,81 @@ func TestGetSCSIAddress(t *testing.T) {
 		assert.Equal(t, scsiAddr, test.expectedSCSIAddress)
 	}
 }
+
+func TestGetDevicePathSCSIWholeDevice(t *testing.T) {
+	defer func() { scsiBlockSysfsTemplate = "/sys/bus/scsi/devices/%d:0:%d:%d/block" }()
+
+	sysfsRoot := filepath.Join(t.TempDir(), "sys", "bus", "scsi", "devices", "%d:0:%d:%d", "block")
+	scsiBlockSysfsTemplate = sysfsRoot
+
+	blockDir := fmt.Sprintf(sysfsRoot, 0, 0, 3)
+	assert.NoError(t, os.MkdirAll(filepath.Join(blockDir, "sdc"), mountPerm))
+
+	path, err := GetDevicePath(context.Background(), 0, 3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sdc", path)
+}
+
+func TestGetDevicePathSCSIPartition(t *testing.T) {
+	defer func() { scsiBlockSysfsTemplate = "/sys/bus/scsi/devices/%d:0:%d:%d/block" }()
+
+	sysfsRoot := filepath.Join(t.TempDir(), "sys", "bus", "scsi", "devices", "%d:0:%d:%d", "block")
+	scsiBlockSysfsTemplate = sysfsRoot
+
+	blockDir := fmt.Sprintf(sysfsRoot, 0, 0, 1)
+	assert.NoError(t, os.MkdirAll(filepath.Join(blockDir, "sda", "sda1"), mountPerm))
+
+	path, err := GetDevicePath(context.Background(), 0, 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sda1", path)
+}
+
+func TestGetDevicePathSCSIPartitionWaits(t *testing.T) {
+	defer func() { scsiBlockSysfsTemplate = "/sys/bus/scsi/devices/%d:0:%d:%d/block" }()
+
+	sysfsRoot := filepath.Join(t.TempDir(), "sys", "bus", "scsi", "devices", "%d:0:%d:%d", "block")
+	scsiBlockSysfsTemplate = sysfsRoot
+
+	blockDir := fmt.Sprintf(sysfsRoot, 0, 0, 2)
+	assert.NoError(t, os.MkdirAll(filepath.Join(blockDir, "sdb"), mountPerm))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.MkdirAll(filepath.Join(blockDir, "sdb", "sdb2"), mountPerm)
+	}()
+
+	path, err := GetDevicePath(context.Background(), 0, 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/sdb2", path)
+}
+
+func TestGetDevicePathSCSIPartitionTimeout(t *testing.T) {
+	defer func() { scsiBlockSysfsTemplate = "/sys/bus/scsi/devices/%d:0:%d:%d/block" }()
+	defer func() { watchBlockDeviceTimeout = 5 * time.Second }()
+	watchBlockDeviceTimeout = 50 * time.Millisecond
+	watchBlockDevicePollInterval = 10 * time.Millisecond
+
+	sysfsRoot := filepath.Join(t.TempDir(), "sys", "bus", "scsi", "devices", "%d:0:%d:%d", "block")
+	scsiBlockSysfsTemplate = sysfsRoot
+
+	blockDir := fmt.Sprintf(sysfsRoot, 0, 0, 4)
+	assert.NoError(t, os.MkdirAll(filepath.Join(blockDir, "sdd"), mountPerm))
+
+	// sdd1 is never created, so the call must time out rather than hang.
+	_, err := GetDevicePath(context.Background(), 0, 4, 1)
+	assert.Error(t, err)
+}
+
+func TestGetDevicePathVirtio(t *testing.T) {
+	path, err := GetDevicePath(context.Background(), virtioControllerIndex, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vda", path)
+
+	path, err = GetDevicePath(context.Background(), virtioControllerIndex, 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vda3", path)
+
+	path, err = GetDevicePath(context.Background(), virtioControllerIndex, 27, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdab1", path)
+}
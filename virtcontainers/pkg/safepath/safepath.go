@@ -0,0 +1,325 @@
+// Copyright (c) 2020 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package safepath provides symlink-safe path resolution primitives built on
+// the Linux `*at` syscall family (openat, fstatat, readlinkat, mkdirat).
+//
+// Resolving a path as a string and then using that string in a later
+// operation is inherently racy: an attacker who controls part of the path
+// can swap a symlink in between the two steps (TOCTOU). The Path type in
+// this package instead keeps the already-opened file descriptor of the
+// resolved location around, so that later operations act on the fd rather
+// than re-resolving the string.
+package safepath
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Path is a resolved, symlink-free location: a file descriptor opened with
+// O_NOFOLLOW (directly, or as the final component of a no-follow walk),
+// together with the absolute path it was resolved from. Callers should
+// prefer passing a Path around over passing its path string, so that
+// subsequent operations reuse the verified fd instead of re-resolving (and
+// potentially re-racing) the string.
+type Path struct {
+	fd   int
+	path string
+}
+
+// Close releases the file descriptor backing p. It is safe to call on a
+// zero-value Path.
+func (p *Path) Close() error {
+	if p == nil || p.fd == 0 {
+		return nil
+	}
+
+	fd := p.fd
+	p.fd = 0
+	return syscall.Close(fd)
+}
+
+// Path returns the absolute path p was resolved from. It is provided for
+// logging and error messages; operations on p should go through its
+// methods (or the fd-based helpers below) rather than re-resolving this
+// string.
+func (p *Path) Path() string {
+	return p.path
+}
+
+// Fd returns the underlying file descriptor.
+func (p *Path) Fd() int {
+	return p.fd
+}
+
+// OpenNoFollow opens root (which must be an absolute, already-trusted path,
+// typically a container rootfs or sandbox directory) and returns it as a
+// Path to be used as the base for JoinNoFollow.
+func OpenNoFollow(root string) (*Path, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", root, err)
+	}
+
+	return &Path{fd: fd, path: root}, nil
+}
+
+// JoinNoFollow resolves relPath against base one component at a time using
+// openat with O_NOFOLLOW, refusing to follow any symlink encountered along
+// the way (including as the final component). This closes the TOCTOU window
+// where a path is resolved to a string, checked, and only later used: here
+// the fd returned is the exact location that was checked.
+func JoinNoFollow(base *Path, relPath string) (*Path, error) {
+	if filepath.IsAbs(relPath) {
+		return nil, fmt.Errorf("relPath must be relative, got %q", relPath)
+	}
+
+	clean := filepath.Clean(relPath)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, fmt.Errorf("refusing to traverse above base with %q", relPath)
+	}
+
+	curFd := base.fd
+	curPath := base.path
+	opened := false
+	success := false
+
+	defer func() {
+		if opened && !success {
+			syscall.Close(curFd)
+		}
+	}()
+
+	if clean == "." {
+		dupFd, err := unix.Dup(curFd)
+		if err != nil {
+			return nil, err
+		}
+		success = true
+		return &Path{fd: dupFd, path: curPath}, nil
+	}
+
+	components := strings.Split(clean, string(filepath.Separator))
+	for i, component := range components {
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			return nil, fmt.Errorf("refusing to traverse above base with %q", relPath)
+		}
+
+		last := i == len(components)-1
+
+		flags := unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		if !last {
+			flags |= unix.O_DIRECTORY
+		}
+
+		nextFd, err := unix.Openat(curFd, component, flags, 0)
+		if err != nil {
+			return nil, fmt.Errorf("openat %s (component %q): %w", curPath, component, err)
+		}
+
+		if last {
+			// O_PATH|O_NOFOLLOW without O_DIRECTORY does not make
+			// openat(2) reject a symlink: it instead succeeds and
+			// returns an fd referring to the symlink itself. Check
+			// explicitly so a symlink planted as the final
+			// component is refused like any other.
+			var stat unix.Stat_t
+			if err := unix.Fstat(nextFd, &stat); err != nil {
+				syscall.Close(nextFd)
+				return nil, fmt.Errorf("fstat %s (component %q): %w", curPath, component, err)
+			}
+			if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+				syscall.Close(nextFd)
+				return nil, fmt.Errorf("refusing to follow symlink %s/%s", curPath, component)
+			}
+		}
+
+		if opened {
+			syscall.Close(curFd)
+		}
+		curFd = nextFd
+		curPath = filepath.Join(curPath, component)
+		opened = true
+	}
+
+	success = true
+	return &Path{fd: curFd, path: curPath}, nil
+}
+
+// StatNoFollow returns the result of fstat(2) on p's fd, i.e. the status of
+// the exact, already-resolved location p refers to, with no further path
+// lookup (and therefore no further chance of a symlink swap).
+func StatNoFollow(p *Path) (os.FileInfo, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(p.fd, &stat); err != nil {
+		return nil, fmt.Errorf("fstat %s: %w", p.path, err)
+	}
+
+	return os.Stat(procFdPath(p.fd))
+}
+
+// MkdirAllNoFollow behaves like os.MkdirAll(filepath.Join(base.Path(),
+// relPath), perm), but walks the existing prefix of relPath with
+// JoinNoFollow and creates any missing trailing components with mkdirat, so
+// a symlink planted partway down relPath cannot redirect the creation.
+func MkdirAllNoFollow(base *Path, relPath string, perm os.FileMode) (*Path, error) {
+	clean := filepath.Clean(relPath)
+	components := strings.Split(clean, string(filepath.Separator))
+
+	cur := base
+	closeCur := func() {}
+
+	for _, component := range components {
+		if component == "" || component == "." {
+			continue
+		}
+
+		next, err := JoinNoFollow(cur, component)
+		if err != nil {
+			if err := unix.Mkdirat(cur.fd, component, uint32(perm)); err != nil && err != unix.EEXIST {
+				closeCur()
+				return nil, fmt.Errorf("mkdirat %s/%s: %w", cur.path, component, err)
+			}
+
+			next, err = JoinNoFollow(cur, component)
+			if err != nil {
+				closeCur()
+				return nil, err
+			}
+		}
+
+		closeCur()
+		cur = next
+		closeCur = func() { cur.Close() }
+	}
+
+	return cur, nil
+}
+
+// BindMountAt bind mounts the location referenced by source (an
+// already-resolved Path) onto destination (also an already-resolved Path),
+// via /proc/self/fd, so neither side of the mount can be swapped out
+// between resolution and the mount(2) call.
+func BindMountAt(source, destination *Path, readonly bool) error {
+	sourcePath := procFdPath(source.fd)
+	destPath := procFdPath(destination.fd)
+
+	if err := unix.Mount(sourcePath, destPath, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s to %s: %w", source.path, destination.path, err)
+	}
+
+	if !readonly {
+		return nil
+	}
+
+	if err := unix.Mount(sourcePath, destPath, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount %s readonly: %w", destination.path, err)
+	}
+
+	return nil
+}
+
+// DeviceForFD returns the mount point backing p's fd, resolved by walking
+// /proc/self/mountinfo for the entry whose mount point (fields[4]) is an
+// ancestor of p's already-verified path and matches the fd's device
+// major:minor (read via fstat on the fd itself, rather than by re-resolving
+// p's path string).
+//
+// The device number match alone is not enough to pick a mountpoint: bind
+// mounts, btrfs subvolumes and the root filesystem itself routinely share a
+// device number with other mounts, so it is used only to validate the
+// ancestor-of-path candidates, not to select among unrelated ones. Among
+// candidates that pass both checks, the shallowest one wins: a bind mount
+// of rootfs onto some deeper path is still backed by the same device as
+// rootfs itself, and callers comparing two paths' devices expect them to
+// agree on the canonical mount rather than on whichever bind alias happens
+// to be the more specific ancestor.
+func DeviceForFD(p *Path) (mountPoint string, err error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(p.fd, &stat); err != nil {
+		return "", fmt.Errorf("fstat %s: %w", p.path, err)
+	}
+
+	wantMajor := unix.Major(stat.Dev)
+	wantMinor := unix.Minor(stat.Dev)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	best := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+
+		majMin := strings.SplitN(fields[2], ":", 2)
+		if len(majMin) != 2 {
+			continue
+		}
+
+		maj, err1 := strconv.Atoi(majMin[0])
+		min, err2 := strconv.Atoi(majMin[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		if uint32(maj) != wantMajor || uint32(min) != wantMinor {
+			continue
+		}
+
+		if !isAncestorPath(fields[4], p.path) {
+			continue
+		}
+
+		if best == "" || len(fields[4]) < len(best) {
+			best = fields[4]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("no mount point found for device %d:%d", wantMajor, wantMinor)
+	}
+
+	return best, nil
+}
+
+// isAncestorPath reports whether mountPoint is path itself or a
+// directory prefix of path, i.e. whether path could actually be located
+// under that mount.
+func isAncestorPath(mountPoint, path string) bool {
+	if mountPoint == "/" {
+		return true
+	}
+
+	if !strings.HasPrefix(path, mountPoint) {
+		return false
+	}
+
+	return len(path) == len(mountPoint) || path[len(mountPoint)] == '/'
+}
+
+func procFdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package safepath
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinNoFollowRefusesSymlink(t *testing.T) {
+	dir := t.TempDir()
+
+	outside := filepath.Join(dir, "outside")
+	assert.NoError(t, os.MkdirAll(outside, 0755))
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.MkdirAll(target, 0755))
+
+	// Plant a symlink at the location a caller might expect a plain
+	// subdirectory, racing whoever resolves it next.
+	link := filepath.Join(target, "evil")
+	assert.NoError(t, os.Symlink(outside, link))
+
+	base, err := OpenNoFollow(target)
+	assert.NoError(t, err)
+	defer base.Close()
+
+	_, err = JoinNoFollow(base, "evil")
+	assert.Error(t, err)
+}
+
+func TestJoinNoFollowRefusesParentEscape(t *testing.T) {
+	dir := t.TempDir()
+
+	base, err := OpenNoFollow(dir)
+	assert.NoError(t, err)
+	defer base.Close()
+
+	_, err = JoinNoFollow(base, "../escape")
+	assert.Error(t, err)
+}
+
+func TestJoinNoFollowResolvesPlainSubdir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+
+	base, err := OpenNoFollow(dir)
+	assert.NoError(t, err)
+	defer base.Close()
+
+	resolved, err := JoinNoFollow(base, "a/b")
+	assert.NoError(t, err)
+	defer resolved.Close()
+
+	assert.Equal(t, filepath.Join(dir, "a", "b"), resolved.Path())
+}
+
+func TestBindMountAtUsesResolvedSourceAfterSwap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+
+	dir := t.TempDir()
+
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, os.MkdirAll(source, 0755))
+
+	dest := filepath.Join(dir, "dest")
+	assert.NoError(t, os.MkdirAll(dest, 0755))
+
+	sourceBase, err := OpenNoFollow(dir)
+	assert.NoError(t, err)
+	defer sourceBase.Close()
+
+	sourcePath, err := JoinNoFollow(sourceBase, "source")
+	assert.NoError(t, err)
+	defer sourcePath.Close()
+
+	destPath, err := JoinNoFollow(sourceBase, "dest")
+	assert.NoError(t, err)
+	defer destPath.Close()
+
+	// Swap "source" for a symlink to somewhere else after it was
+	// resolved: the bind mount below must still act on the fd captured
+	// above, not the (now attacker-controlled) path string. Move the
+	// original directory aside rather than deleting it outright -
+	// mount(2) on a /proc/self/fd reference to a fully unlinked
+	// directory fails with ENOENT, which would defeat the test for
+	// reasons unrelated to the TOCTOU behavior being verified here.
+	elsewhere := filepath.Join(dir, "source-moved")
+	assert.NoError(t, os.Rename(source, elsewhere))
+	assert.NoError(t, os.Symlink("/etc", source))
+
+	err = BindMountAt(sourcePath, destPath, false)
+	assert.NoError(t, err)
+	defer syscall.Unmount(dest, 0)
+}